@@ -0,0 +1,140 @@
+package bidirpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+type EchoArgs struct{ N int }
+type EchoReply struct{ N int }
+
+// Echo is a minimal net/rpc-style service used by the round-trip tests
+// below.
+type Echo struct{}
+
+func (Echo) Double(args *EchoArgs, reply *EchoReply) error {
+	reply.N = args.N * 2
+	return nil
+}
+
+// newSessionPair wires up a connected client/server Session pair over
+// net.Pipe, the way a real caller would over a net.Conn.
+func newSessionPair(t *testing.T) (client, server *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+
+	client, err := NewSession(a, true, 0)
+	if err != nil {
+		t.Fatalf("NewSession(client): %v", err)
+	}
+	server, err = NewSession(b, false, 0)
+	if err != nil {
+		t.Fatalf("NewSession(server): %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestCallRoundTrip(t *testing.T) {
+	client, server := newSessionPair(t)
+	if err := server.Register(Echo{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	var reply EchoReply
+	if err := client.Call("Echo.Double", &EchoArgs{N: 21}, &reply); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if reply.N != 42 {
+		t.Fatalf("reply.N = %d, want 42", reply.N)
+	}
+}
+
+func TestClientStreamCancelUnblocksRecv(t *testing.T) {
+	client, server := newSessionPair(t)
+	server.RegisterStream("Echo.Stream", func(ctx context.Context, stream *ServerStream) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	cs, err := client.NewClientStream("Echo.Stream")
+	if err != nil {
+		t.Fatalf("NewClientStream: %v", err)
+	}
+	cs.Cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		var msg EchoReply
+		done <- cs.Recv(&msg)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Recv returned a nil error after Cancel")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Recv never returned after Cancel")
+	}
+}
+
+func TestGoAppliesClientMiddleware(t *testing.T) {
+	client, server := newSessionPair(t)
+	if err := server.Register(Echo{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	var invoked bool
+	client.UseClient(func(serviceMethod string, args, reply interface{}, next func() error) error {
+		invoked = true
+		return next()
+	})
+
+	var reply EchoReply
+	call := client.Go("Echo.Double", &EchoArgs{N: 10}, &reply, nil)
+	select {
+	case <-call.Done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Go call never completed")
+	}
+	if call.Error != nil {
+		t.Fatalf("call.Error = %v", call.Error)
+	}
+	if !invoked {
+		t.Fatal("client middleware installed via UseClient was not invoked for Go")
+	}
+	if reply.N != 20 {
+		t.Fatalf("reply.N = %d, want 20", reply.N)
+	}
+}
+
+func TestSessionCloseCancelsStreamHandler(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	handlerDone := make(chan struct{})
+	server.RegisterStream("Echo.Stream", func(ctx context.Context, stream *ServerStream) error {
+		<-ctx.Done()
+		close(handlerDone)
+		return ctx.Err()
+	})
+
+	if _, err := client.NewClientStream("Echo.Stream"); err != nil {
+		t.Fatalf("NewClientStream: %v", err)
+	}
+
+	// Give the request frame time to reach the server and register its
+	// handler before closing it.
+	time.Sleep(50 * time.Millisecond)
+	server.Close()
+
+	select {
+	case <-handlerDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("StreamHandler never observed session close via ctx.Done()")
+	}
+}
@@ -0,0 +1,39 @@
+package bidirpc
+
+import (
+	"bytes"
+	"sync"
+)
+
+// bufferPool recycles the *bytes.Buffer readLoop decodes each frame body
+// into, so a steady stream of small messages doesn't allocate on every
+// frame. maxSize bounds how large a buffer it will hold onto.
+type bufferPool struct {
+	pool    sync.Pool
+	maxSize int
+}
+
+func newBufferPool(maxSize int) *bufferPool {
+	return &bufferPool{
+		maxSize: maxSize,
+		pool: sync.Pool{
+			New: func() interface{} { return new(bytes.Buffer) },
+		},
+	}
+}
+
+func (p *bufferPool) Get() *bytes.Buffer {
+	return p.pool.Get().(*bytes.Buffer)
+}
+
+// Put returns b to the pool, unless its backing array has grown past
+// maxSize: pooling a one-off huge message would otherwise bloat the pool
+// with a giant buffer that every subsequent small message allocation then
+// holds onto indefinitely.
+func (p *bufferPool) Put(b *bytes.Buffer) {
+	if p.maxSize > 0 && b.Cap() > p.maxSize {
+		return
+	}
+	b.Reset()
+	p.pool.Put(b)
+}
@@ -0,0 +1,384 @@
+package bidirpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// callKind identifies what a frame multiplexed on streamTypeCall carries.
+type callKind byte
+
+const (
+	callKindRequest callKind = iota + 1
+	callKindChunk
+	callKindEnd
+	callKindError
+	callKindCancel
+)
+
+const callFrameHeaderLen = 8 + 1 // callID + kind
+
+// encodeCallFrame prepends the callID/kind header used to multiplex
+// concurrent streaming calls over the single streamTypeCall channel.
+func encodeCallFrame(callID uint64, kind callKind, payload []byte) []byte {
+	buf := make([]byte, callFrameHeaderLen+len(payload))
+	binary.BigEndian.PutUint64(buf[:8], callID)
+	buf[8] = byte(kind)
+	copy(buf[callFrameHeaderLen:], payload)
+	return buf
+}
+
+func decodeCallFrame(b []byte) (callID uint64, kind callKind, payload []byte, err error) {
+	if len(b) < callFrameHeaderLen {
+		return 0, 0, nil, fmt.Errorf("call frame too short: %d bytes", len(b))
+	}
+	callID = binary.BigEndian.Uint64(b[:8])
+	kind = callKind(b[8])
+	payload = b[callFrameHeaderLen:]
+	return callID, kind, payload, nil
+}
+
+// StreamHandler handles one incoming bidirectional streaming call.
+// It is invoked in its own goroutine and should run until the stream
+// is exhausted or ctx is done.
+type StreamHandler func(ctx context.Context, stream *ServerStream) error
+
+// callRoute is the per-call mailbox readLoop delivers frames into. Frames
+// are appended to an unbounded, order-preserving pending queue (push never
+// blocks, so one slow call can't stall readLoop for the whole session) and
+// a dedicated forwarder goroutine drains that queue into the bounded
+// frames channel Recv reads from, blocking only itself against a slow
+// consumer.
+type callRoute struct {
+	cancel context.CancelFunc
+	frames chan callFrame
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []callFrame
+	closed  bool
+}
+
+func newCallRoute(cancel context.CancelFunc) *callRoute {
+	r := &callRoute{cancel: cancel, frames: make(chan callFrame, 16)}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// push enqueues f without blocking the caller (readLoop).
+func (r *callRoute) push(f callFrame) {
+	r.mu.Lock()
+	r.pending = append(r.pending, f)
+	r.mu.Unlock()
+	r.cond.Signal()
+}
+
+// forward drains pending into frames, in order, until the route is closed
+// or the session is. It is the sole sender on frames, so it closes frames
+// before returning: that's what unblocks a Recv parked on <-r.frames when
+// the route is torn down by cancellation rather than by an end/error frame
+// that already happens to be waiting in pending.
+func (r *callRoute) forward(closedC chan struct{}) {
+	defer close(r.frames)
+	for {
+		r.mu.Lock()
+		for len(r.pending) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if len(r.pending) == 0 && r.closed {
+			r.mu.Unlock()
+			return
+		}
+		f := r.pending[0]
+		r.pending = r.pending[1:]
+		r.mu.Unlock()
+
+		select {
+		case r.frames <- f:
+		case <-closedC:
+			return
+		}
+	}
+}
+
+func (r *callRoute) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.cond.Signal()
+}
+
+// removeCall drops callID's route from the session so it stops accumulating
+// frames (and, once the last reference to it is gone, gets collected).
+func (s *Session) removeCall(callID uint64) {
+	s.streamMu.Lock()
+	route, ok := s.calls[callID]
+	delete(s.calls, callID)
+	s.streamMu.Unlock()
+	if ok {
+		route.close()
+	}
+}
+
+// cancelAllCalls cancels and tears down every in-flight call route, e.g.
+// when the session is closing and no further frames will ever arrive for
+// them — without this, a StreamHandler blocked on <-ctx.Done(), or a
+// RecvStream.Recv blocked on <-route.frames, would never return, exactly
+// what ServerStream.Context's doc comment promises doesn't happen.
+func (s *Session) cancelAllCalls() {
+	s.streamMu.Lock()
+	routes := make([]*callRoute, 0, len(s.calls))
+	for _, route := range s.calls {
+		routes = append(routes, route)
+	}
+	s.calls = nil
+	s.streamMu.Unlock()
+
+	for _, route := range routes {
+		route.cancel()
+		route.close()
+	}
+}
+
+type callFrame struct {
+	kind    callKind
+	payload []byte
+}
+
+// RecvStream is the receive half of a streaming call.
+type RecvStream struct {
+	sess   *Session
+	callID uint64
+	route  *callRoute
+	done   bool
+}
+
+// Recv decodes the next message sent by the peer into msg. It returns an
+// error satisfying errors.Is(err, io.EOF) once the peer has ended the
+// stream.
+func (r *RecvStream) Recv(msg interface{}) error {
+	if r.done {
+		return fmt.Errorf("bidirpc: Recv called after stream end")
+	}
+	f, ok := <-r.route.frames
+	if !ok {
+		r.done = true
+		r.sess.removeCall(r.callID)
+		return fmt.Errorf("bidirpc: stream closed")
+	}
+	switch f.kind {
+	case callKindEnd:
+		r.done = true
+		r.sess.removeCall(r.callID)
+		return fmt.Errorf("bidirpc: %w", io.EOF)
+	case callKindError:
+		r.done = true
+		r.sess.removeCall(r.callID)
+		return fmt.Errorf("bidirpc: %s", string(f.payload))
+	case callKindChunk, callKindRequest:
+		return gob.NewDecoder(bytes.NewReader(f.payload)).Decode(msg)
+	default:
+		return fmt.Errorf("bidirpc: unexpected frame kind %d", f.kind)
+	}
+}
+
+// SendStream is the send half of a streaming call.
+type SendStream struct {
+	sess   *Session
+	callID uint64
+	mu     sync.Mutex
+	ended  bool
+}
+
+// Send encodes msg and delivers it as the next chunk of the stream.
+func (s *SendStream) Send(msg interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return fmt.Errorf("bidirpc: Send called after CloseSend")
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return err
+	}
+	return s.sess.writeCallFrame(s.callID, callKindChunk, buf.Bytes())
+}
+
+// CloseSend signals to the peer that no further messages will be sent.
+func (s *SendStream) CloseSend() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return nil
+	}
+	s.ended = true
+	return s.sess.writeCallFrame(s.callID, callKindEnd, nil)
+}
+
+// ClientStream is a bidirectional stream opened by NewClientStream.
+type ClientStream struct {
+	SendStream
+	RecvStream
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Context returns the context governing the client side of the call.
+// Cancelling it sends a cancel frame to the server.
+func (c *ClientStream) Context() context.Context { return c.ctx }
+
+// Cancel aborts the call, notifying the server so it can stop its handler.
+func (c *ClientStream) Cancel() {
+	c.cancel()
+}
+
+// ServerStream is a bidirectional stream delivered to a StreamHandler.
+type ServerStream struct {
+	SendStream
+	RecvStream
+	ctx context.Context
+}
+
+// Context returns the per-call context; it is cancelled when the client
+// sends a cancel frame or the connection is closed.
+func (s *ServerStream) Context() context.Context { return s.ctx }
+
+// RegisterStream registers a streaming handler under serviceMethod, the
+// same "Type.Method" naming convention used by Register/RegisterName.
+func (s *Session) RegisterStream(serviceMethod string, handler StreamHandler) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if s.streamHandlers == nil {
+		s.streamHandlers = make(map[string]StreamHandler)
+	}
+	s.streamHandlers[serviceMethod] = handler
+}
+
+// NewClientStream opens a new bidirectional streaming call to serviceMethod.
+func (s *Session) NewClientStream(serviceMethod string) (*ClientStream, error) {
+	// The two peers number their streams with opposite parity (yin odd,
+	// yang even) so IDs they open concurrently never collide in s.calls.
+	callID := atomic.AddUint64(&s.nextCallID, 1) * 2
+	if s.yinOrYang {
+		callID--
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	route := newCallRoute(cancel)
+	go route.forward(s.closedC)
+
+	s.streamMu.Lock()
+	if s.calls == nil {
+		s.calls = make(map[uint64]*callRoute)
+	}
+	s.calls[callID] = route
+	s.streamMu.Unlock()
+
+	cs := &ClientStream{
+		SendStream: SendStream{sess: s, callID: callID},
+		RecvStream: RecvStream{sess: s, callID: callID, route: route},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.Canceled {
+			_ = s.writeCallFrame(callID, callKindCancel, nil)
+		}
+		s.removeCall(callID)
+	}()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(serviceMethod); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := s.writeCallFrame(callID, callKindRequest, buf.Bytes()); err != nil {
+		cancel()
+		return nil, err
+	}
+	return cs, nil
+}
+
+// writeCallFrame wraps a call frame in the outer yin/yang-style header and
+// writes it to the connection.
+func (s *Session) writeCallFrame(callID uint64, kind callKind, payload []byte) error {
+	body := encodeCallFrame(callID, kind, payload)
+	return s.write(encodeHeader(streamTypeCall, body))
+}
+
+// dispatchCallFrame routes a frame read by readLoop to the right call, or,
+// for callKindRequest, starts a new server-side stream handler goroutine.
+func (s *Session) dispatchCallFrame(body []byte) {
+	callID, kind, payload, err := decodeCallFrame(body)
+	if err != nil {
+		return
+	}
+
+	if kind == callKindRequest {
+		var serviceMethod string
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&serviceMethod); err != nil {
+			return
+		}
+		s.streamMu.RLock()
+		handler := s.streamHandlers[serviceMethod]
+		s.streamMu.RUnlock()
+		if handler == nil {
+			_ = s.writeCallFrame(callID, callKindError, []byte(fmt.Sprintf("bidirpc: unknown stream method %q", serviceMethod)))
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		route := newCallRoute(cancel)
+		go route.forward(s.closedC)
+		s.streamMu.Lock()
+		if s.calls == nil {
+			s.calls = make(map[uint64]*callRoute)
+		}
+		s.calls[callID] = route
+		s.streamMu.Unlock()
+
+		ss := &ServerStream{
+			SendStream: SendStream{sess: s, callID: callID},
+			RecvStream: RecvStream{sess: s, callID: callID, route: route},
+			ctx:        ctx,
+		}
+		go func() {
+			defer cancel()
+			defer s.removeCall(callID)
+			if err := handler(ctx, ss); err != nil {
+				_ = s.writeCallFrame(callID, callKindError, []byte(err.Error()))
+			}
+		}()
+		return
+	}
+
+	if kind == callKindCancel {
+		s.streamMu.RLock()
+		route := s.calls[callID]
+		s.streamMu.RUnlock()
+		if route != nil {
+			route.cancel()
+		}
+		return
+	}
+
+	s.streamMu.RLock()
+	route := s.calls[callID]
+	s.streamMu.RUnlock()
+	if route == nil {
+		return
+	}
+	// push never blocks: a handler that isn't calling Recv fast enough only
+	// backs up its own route's pending queue, not readLoop or any other
+	// streaming call, ping or control frame sharing this session. payload is
+	// copied because it aliases a pooled buffer readLoop reuses for the next
+	// frame.
+	route.push(callFrame{kind: kind, payload: append([]byte(nil), payload...)})
+}
@@ -0,0 +1,22 @@
+// Package jsonrpc implements bidirpc.Codec using encoding/json, so two
+// bidirpc peers can exchange calls as JSON instead of the default gob
+// encoding.
+package jsonrpc
+
+import "encoding/json"
+
+// Codec marshals values as JSON.
+type Codec struct{}
+
+// New returns a JSON Codec.
+func New() Codec { return Codec{} }
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (Codec) Name() string { return "json" }
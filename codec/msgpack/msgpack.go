@@ -0,0 +1,21 @@
+// Package msgpack implements bidirpc.Codec on top of vmihailenco/msgpack,
+// trading gob's Go-specific encoding for a compact, language-neutral one.
+package msgpack
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// Codec marshals values as MsgPack.
+type Codec struct{}
+
+// New returns a MsgPack Codec.
+func New() Codec { return Codec{} }
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (Codec) Name() string { return "msgpack" }
@@ -0,0 +1,39 @@
+// Package protorpc implements bidirpc.Codec on top of protobuf wire
+// encoding. Values that implement proto.Message are encoded as protobuf;
+// any other value, including bidirpc's own rpc.Request/rpc.Response headers
+// (net/rpc does not define them as proto messages), falls back to gob.
+package protorpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec marshals proto.Message values as protobuf wire format.
+type Codec struct{}
+
+// New returns a Protobuf Codec.
+func New() Codec { return Codec{} }
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, fmt.Errorf("protorpc: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (Codec) Name() string { return "protobuf" }
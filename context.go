@@ -0,0 +1,267 @@
+package bidirpc
+
+import (
+	"context"
+	"encoding/binary"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// controlKind identifies what a frame multiplexed on streamTypeControl
+// carries. Control frames ride alongside the normal request/response
+// traffic to propagate a CallContext/GoContext's deadline and cancellation,
+// keyed by the same Seq net/rpc already assigns each call.
+type controlKind byte
+
+const (
+	controlKindDeadline controlKind = iota + 1
+	controlKindCancel
+)
+
+type controlFrame struct {
+	kind    controlKind
+	payload []byte
+}
+
+func encodeControlFrame(seq uint64, kind controlKind, payload []byte) []byte {
+	buf := make([]byte, callFrameHeaderLen+len(payload))
+	binary.BigEndian.PutUint64(buf[:8], seq)
+	buf[8] = byte(kind)
+	copy(buf[callFrameHeaderLen:], payload)
+	return buf
+}
+
+func decodeControlFrame(b []byte) (seq uint64, kind controlKind, payload []byte, err error) {
+	id, k, p, err := decodeCallFrame(b)
+	return id, controlKind(k), p, err
+}
+
+// pendingCtxSlot hands a CallContext/GoContext's context.Context across to
+// the ctxClientCodec.WriteRequest call that learns the Seq it was assigned.
+// consumed guards against it being used twice: once by WriteRequest in the
+// common case, or by the caller itself if the request was never written
+// (e.g. the client is shutting down).
+type pendingCtxSlot struct {
+	ctx      context.Context
+	consumed int32
+}
+
+// ctxClientCodec decorates the Session's rpc.ClientCodec to learn the Seq
+// assigned to each outgoing request, so a pending deadline/cancellation can
+// be armed against it.
+type ctxClientCodec struct {
+	rpc.ClientCodec
+	sess *Session
+}
+
+func (c *ctxClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	err := c.ClientCodec.WriteRequest(r, body)
+	if slot := c.sess.pendingCtx; slot != nil && atomic.CompareAndSwapInt32(&slot.consumed, 0, 1) {
+		c.sess.pendingCtx = nil
+		c.sess.ctxMu.Unlock()
+		if err == nil {
+			c.sess.armCallContext(r.Seq, slot.ctx)
+		}
+	}
+	return err
+}
+
+// CallContext is Call with a context.Context: its deadline and cancellation
+// are propagated to the server so a handler built around CallContext's
+// context on the server side observes the same deadline/cancellation.
+func (s *Session) CallContext(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	return s.callWithMiddleware(ctx, serviceMethod, args, reply)
+}
+
+// GoContext is Go with a context.Context; see CallContext. It runs
+// callWithMiddleware (the same client middleware chain Call/CallContext
+// use) on its own goroutine, reporting completion through the returned
+// *rpc.Call exactly as rpc.Client.Go would.
+func (s *Session) GoContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *rpc.Call) *rpc.Call {
+	if done == nil {
+		done = make(chan *rpc.Call, 10)
+	} else if cap(done) == 0 {
+		panic("bidirpc: done channel is unbuffered")
+	}
+	call := &rpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+
+	go func() {
+		call.Error = s.callWithMiddleware(ctx, serviceMethod, args, reply)
+		select {
+		case call.Done <- call:
+		default:
+		}
+	}()
+	return call
+}
+
+// doCall arms ctx against the next request written on the wire, then
+// performs a blocking Call.
+func (s *Session) doCall(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	slot := &pendingCtxSlot{ctx: ctx}
+
+	s.ctxMu.Lock()
+	s.pendingCtx = slot
+	err := s.client.Call(serviceMethod, args, reply)
+	// If WriteRequest never ran (e.g. the client is shutting down), release
+	// the slot ourselves so a future call doesn't deadlock on s.ctxMu.
+	if atomic.CompareAndSwapInt32(&slot.consumed, 0, 1) {
+		s.pendingCtx = nil
+		s.ctxMu.Unlock()
+	}
+	return err
+}
+
+// armCallContext sends ctx's deadline (if any) to the peer and watches for
+// cancellation, notifying the peer with a cancel control frame.
+func (s *Session) armCallContext(seq uint64, ctx context.Context) {
+	if ctx == nil || ctx.Done() == nil {
+		return
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		var payload [8]byte
+		binary.BigEndian.PutUint64(payload[:], uint64(time.Until(dl)))
+		_ = s.writeControlFrame(seq, controlKindDeadline, payload[:])
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				_ = s.writeControlFrame(seq, controlKindCancel, nil)
+			}
+		case <-s.closedC:
+		}
+	}()
+}
+
+func (s *Session) writeControlFrame(seq uint64, kind controlKind, payload []byte) error {
+	body := encodeControlFrame(seq, kind, payload)
+	return s.write(encodeHeader(streamTypeControl, body))
+}
+
+// ctxCall is the server-side bookkeeping for one in-flight CallContext'd
+// request: cancel tears down the context.Context the handler runs with.
+// timer, if set, is the pending deadline-driven cancel armed by
+// applyControlFrame; it must be stopped once the call finishes so it
+// doesn't fire (harmlessly, but needlessly) after the fact.
+type ctxCall struct {
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// dispatchControlFrame applies a deadline/cancel frame to the matching
+// in-flight call. Control frames can race the request they apply to (they
+// travel on a different logical stream), so one that arrives first is
+// buffered in ctxPending and replayed once the call registers itself.
+func (s *Session) dispatchControlFrame(body []byte) {
+	seq, kind, payload, err := decodeControlFrame(body)
+	if err != nil {
+		return
+	}
+
+	s.ctxStateMu.Lock()
+	call, ok := s.ctxCalls[seq]
+	if !ok {
+		if s.ctxPending == nil {
+			s.ctxPending = make(map[uint64][]controlFrame)
+		}
+		// Copy payload: it aliases a pooled buffer readLoop reuses.
+		s.ctxPending[seq] = append(s.ctxPending[seq], controlFrame{kind: kind, payload: append([]byte(nil), payload...)})
+		s.ctxStateMu.Unlock()
+		return
+	}
+	s.ctxStateMu.Unlock()
+	s.applyControlFrame(call, kind, payload)
+}
+
+func (s *Session) applyControlFrame(call *ctxCall, kind controlKind, payload []byte) {
+	switch kind {
+	case controlKindCancel:
+		call.cancel()
+	case controlKindDeadline:
+		if len(payload) < 8 {
+			return
+		}
+		d := time.Duration(binary.BigEndian.Uint64(payload))
+		call.mu.Lock()
+		if call.timer != nil {
+			call.timer.Stop()
+		}
+		call.timer = time.AfterFunc(d, call.cancel)
+		call.mu.Unlock()
+	}
+}
+
+// registerCtxCall creates the context.Context a handler for seq runs with,
+// replaying any control frame that raced ahead of the request itself.
+func (s *Session) registerCtxCall(seq uint64) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	call := &ctxCall{cancel: cancel}
+
+	s.ctxStateMu.Lock()
+	if s.ctxCalls == nil {
+		s.ctxCalls = make(map[uint64]*ctxCall)
+	}
+	s.ctxCalls[seq] = call
+	pending := s.ctxPending[seq]
+	delete(s.ctxPending, seq)
+	s.ctxStateMu.Unlock()
+
+	for _, f := range pending {
+		s.applyControlFrame(call, f.kind, f.payload)
+	}
+	return ctx
+}
+
+func (s *Session) unregisterCtxCall(seq uint64) {
+	s.ctxStateMu.Lock()
+	call, ok := s.ctxCalls[seq]
+	delete(s.ctxCalls, seq)
+	s.ctxStateMu.Unlock()
+
+	if !ok {
+		return
+	}
+	call.stopTimer()
+}
+
+func (c *ctxCall) stopTimer() {
+	c.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+}
+
+// cancelAllCtxCalls cancels every in-flight CallContext-propagated handler
+// context, e.g. when the session is closing and no response will ever be
+// sent for them — without this, a handler blocked on <-ctx.Done() would
+// never return.
+func (s *Session) cancelAllCtxCalls() {
+	s.ctxStateMu.Lock()
+	calls := make([]*ctxCall, 0, len(s.ctxCalls))
+	for _, call := range s.ctxCalls {
+		calls = append(calls, call)
+	}
+	s.ctxCalls = nil
+	s.ctxStateMu.Unlock()
+
+	for _, call := range calls {
+		call.stopTimer()
+		call.cancel()
+	}
+}
+
+// discardCtxPending drops any control frames buffered for seq because the
+// call they were meant for will never be registered (e.g. the request
+// named an unknown service method), so they would otherwise sit in
+// ctxPending for the life of the session.
+func (s *Session) discardCtxPending(seq uint64) {
+	s.ctxStateMu.Lock()
+	delete(s.ctxPending, seq)
+	s.ctxStateMu.Unlock()
+}
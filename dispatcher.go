@@ -0,0 +1,254 @@
+package bidirpc
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"io"
+	"log"
+	"net/rpc"
+	"reflect"
+	"sync"
+)
+
+// Handler invokes a single RPC method against already-decoded args/reply
+// values. It is the type both the terminal (actual method call) and each
+// link of a middleware chain are built from.
+type Handler func(ctx context.Context, args, reply interface{}) error
+
+// ServerMiddleware wraps the dispatch of an incoming call. Implementations
+// typically do work before and/or after invoking next, and may choose not
+// to call next at all (e.g. to reject unauthenticated requests).
+type ServerMiddleware func(ctx context.Context, serviceMethod string, args, reply interface{}, next Handler) error
+
+// ClientMiddleware wraps an outgoing Call/Go invocation, symmetrically to
+// ServerMiddleware.
+type ClientMiddleware func(serviceMethod string, args, reply interface{}, next func() error) error
+
+// Use installs server middleware, applied in the order given: the first
+// middleware passed is the outermost, the last wraps the method call
+// directly.
+func (s *Session) Use(mw ...ServerMiddleware) {
+	s.dispatcher.use(mw...)
+}
+
+// UseClient installs client middleware around Call/Go, applied in the order
+// given, outermost first.
+func (s *Session) UseClient(mw ...ClientMiddleware) {
+	s.clientMu.Lock()
+	s.clientMiddleware = append(s.clientMiddleware, mw...)
+	s.clientMu.Unlock()
+}
+
+// dispatcher is a minimal stand-in for rpc.Server: just enough reflection to
+// honor the same Register rules, plus a middleware chain around every call.
+// net/rpc doesn't expose a hook for this, so bidirpc drives its own loop
+// instead of rpc.Server.ServeCodec.
+type dispatcher struct {
+	mu      sync.RWMutex
+	methods map[string]*boundMethod
+	mwMu    sync.RWMutex
+	mw      []ServerMiddleware
+}
+
+type boundMethod struct {
+	receiver  reflect.Value
+	method    reflect.Method
+	argType   reflect.Type
+	replyType reflect.Type
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{methods: make(map[string]*boundMethod)}
+}
+
+func (d *dispatcher) use(mw ...ServerMiddleware) {
+	d.mwMu.Lock()
+	defer d.mwMu.Unlock()
+	d.mw = append(d.mw, mw...)
+}
+
+// register mirrors net/rpc's suitableMethods rules: exported method of an
+// exported type, two args of exported (or builtin) type (the second a
+// pointer), one error return. Like rpc.Server.Register, it logs any error
+// it returns.
+func (d *dispatcher) register(name string, rcvr interface{}) error {
+	v := reflect.ValueOf(rcvr)
+	t := reflect.TypeOf(rcvr)
+	if name == "" {
+		name = reflect.Indirect(v).Type().Name()
+		if name != "" && !token.IsExported(name) {
+			err := fmt.Errorf("bidirpc: type %s is not exported", name)
+			log.Print(err)
+			return err
+		}
+	}
+	if name == "" {
+		err := fmt.Errorf("bidirpc: no service name for type %s", t)
+		log.Print(err)
+		return err
+	}
+	exportedOrBuiltin := func(t reflect.Type) bool {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		return token.IsExported(t.Name()) || t.PkgPath() == ""
+	}
+
+	registered := 0
+	for m := 0; m < t.NumMethod(); m++ {
+		method := t.Method(m)
+		mt := method.Type
+		if method.PkgPath != "" {
+			continue
+		}
+		if mt.NumIn() != 3 {
+			continue
+		}
+		argType := mt.In(1)
+		replyType := mt.In(2)
+		if replyType.Kind() != reflect.Ptr {
+			continue
+		}
+		if !exportedOrBuiltin(argType) || !exportedOrBuiltin(replyType) {
+			continue
+		}
+		if mt.NumOut() != 1 || mt.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+			continue
+		}
+
+		d.mu.Lock()
+		d.methods[name+"."+method.Name] = &boundMethod{
+			receiver:  v,
+			method:    method,
+			argType:   argType,
+			replyType: replyType,
+		}
+		d.mu.Unlock()
+		registered++
+	}
+	if registered == 0 {
+		err := fmt.Errorf("bidirpc: type %s has no exported methods of suitable type", t)
+		log.Print(err)
+		return err
+	}
+	return nil
+}
+
+func (d *dispatcher) lookup(serviceMethod string) (*boundMethod, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	bm, ok := d.methods[serviceMethod]
+	return bm, ok
+}
+
+func (bm *boundMethod) newArgs() reflect.Value {
+	if bm.argType.Kind() == reflect.Ptr {
+		return reflect.New(bm.argType.Elem())
+	}
+	return reflect.New(bm.argType)
+}
+
+func (bm *boundMethod) newReply() reflect.Value {
+	return reflect.New(bm.replyType.Elem())
+}
+
+func (bm *boundMethod) call(args, reply interface{}) error {
+	argv := reflect.ValueOf(args)
+	if bm.argType.Kind() != reflect.Ptr {
+		argv = argv.Elem()
+	}
+	replyv := reflect.ValueOf(reply)
+	out := bm.method.Func.Call([]reflect.Value{bm.receiver, argv, replyv})
+	if errInter := out[0].Interface(); errInter != nil {
+		return errInter.(error)
+	}
+	return nil
+}
+
+// invoke runs serviceMethod through the middleware chain and the bound
+// method itself.
+func (d *dispatcher) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	bm, ok := d.lookup(serviceMethod)
+	if !ok {
+		return fmt.Errorf("bidirpc: can't find service method %s", serviceMethod)
+	}
+
+	base := Handler(func(ctx context.Context, args, reply interface{}) error {
+		return bm.call(args, reply)
+	})
+
+	d.mwMu.RLock()
+	chain := append([]ServerMiddleware(nil), d.mw...)
+	d.mwMu.RUnlock()
+
+	h := base
+	for i := len(chain) - 1; i >= 0; i-- {
+		mw := chain[i]
+		next := h
+		h = func(ctx context.Context, args, reply interface{}) error {
+			return mw(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return h(ctx, args, reply)
+}
+
+// serveCodec drives an rpc.ServerCodec the way rpc.Server.ServeCodec does,
+// except each call is routed through the middleware chain instead of being
+// invoked directly.
+func (s *Session) serveCodec(codec rpc.ServerCodec) {
+	var sending sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer codec.Close()
+
+	for {
+		var req rpc.Request
+		if err := codec.ReadRequestHeader(&req); err != nil {
+			if err != io.EOF {
+				log.Printf("bidirpc: ReadRequestHeader error: %v", err)
+			}
+			return
+		}
+
+		bm, ok := s.dispatcher.lookup(req.ServiceMethod)
+		if !ok {
+			if err := codec.ReadRequestBody(nil); err != nil {
+				return
+			}
+			// This call will never be registered via registerCtxCall, so
+			// drop any control frame a CallContext deadline/cancel already
+			// buffered for it rather than leaking it in ctxPending forever.
+			s.discardCtxPending(req.Seq)
+			resp := &rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq, Error: fmt.Sprintf("bidirpc: can't find service method %s", req.ServiceMethod)}
+			sending.Lock()
+			_ = codec.WriteResponse(resp, struct{}{})
+			sending.Unlock()
+			continue
+		}
+
+		argv := bm.newArgs()
+		if err := codec.ReadRequestBody(argv.Interface()); err != nil {
+			return
+		}
+		replyv := bm.newReply()
+
+		ctx := s.registerCtxCall(req.Seq)
+
+		wg.Add(1)
+		go func(req rpc.Request, argv, replyv reflect.Value, ctx context.Context) {
+			defer wg.Done()
+			defer s.unregisterCtxCall(req.Seq)
+			err := s.dispatcher.invoke(ctx, req.ServiceMethod, argv.Interface(), replyv.Interface())
+			resp := &rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}
+			body := replyv.Interface()
+			if err != nil {
+				resp.Error = err.Error()
+				body = struct{}{}
+			}
+			sending.Lock()
+			_ = codec.WriteResponse(resp, body)
+			sending.Unlock()
+		}(req, argv, replyv, ctx)
+	}
+}
@@ -0,0 +1,72 @@
+package bidirpc
+
+import (
+	"encoding/gob"
+	"net/rpc"
+)
+
+// clientCodec is the default, no-handshake rpc.ClientCodec: gob directly
+// over a stream's byte-oriented Read/Write. It predates the pluggable Codec
+// interface (see codec.go) and stays as the zero-config fast path.
+type clientCodec struct {
+	stream *stream
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+}
+
+func newClientCodec(s *stream) *clientCodec {
+	return &clientCodec{stream: s, enc: gob.NewEncoder(s), dec: gob.NewDecoder(s)}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	return c.enc.Encode(body)
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	if body == nil {
+		var discard struct{}
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *clientCodec) Close() error { return nil }
+
+// serverCodec is the server-side mirror of clientCodec.
+type serverCodec struct {
+	stream *stream
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+}
+
+func newServerCodec(s *stream) *serverCodec {
+	return &serverCodec{stream: s, enc: gob.NewEncoder(s), dec: gob.NewDecoder(s)}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		var discard struct{}
+		return c.dec.Decode(&discard)
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	return c.enc.Encode(body)
+}
+
+func (c *serverCodec) Close() error { return nil }
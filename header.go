@@ -0,0 +1,23 @@
+package bidirpc
+
+const headerLen = 4
+
+// encodeHeader frames body for the wire: a 1-byte stream type, a 3-byte
+// big-endian body length, then body itself.
+func encodeHeader(streamType byte, body []byte) []byte {
+	buf := make([]byte, headerLen+len(body))
+	buf[0] = streamType
+	buf[1] = byte(len(body) >> 16)
+	buf[2] = byte(len(body) >> 8)
+	buf[3] = byte(len(body))
+	copy(buf[headerLen:], body)
+	return buf
+}
+
+// decodeHeader reads the stream type and body length out of a headerLen
+// byte header previously read off the wire; it does not touch the body.
+func decodeHeader(header []byte) (streamType byte, bodyLen int) {
+	streamType = header[0]
+	bodyLen = int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	return streamType, bodyLen
+}
@@ -0,0 +1,72 @@
+package bidirpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// WithKeepalive makes the session send a ping frame every interval and
+// close itself if the peer's pong doesn't arrive within timeout. This
+// catches a half-open connection (NAT rebind, silent peer crash) that a
+// session otherwise only notices the next time it happens to read or write.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(o *sessionOptions) {
+		o.keepaliveInterval = interval
+		o.keepaliveTimeout = timeout
+	}
+}
+
+func encodePingID(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+func decodePingID(b []byte) uint64 {
+	if len(b) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// keepaliveLoop pings the peer on a ticker and closes the session if a pong
+// hasn't come back within timeout.
+func (s *Session) keepaliveLoop(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closedC:
+			return
+		case <-ticker.C:
+			id := atomic.AddUint64(&s.sentPing, 1)
+			if err := s.write(encodeHeader(streamTypePing, encodePingID(id))); err != nil {
+				return
+			}
+			time.AfterFunc(timeout, func() {
+				if atomic.LoadUint64(&s.ackedPing) < id {
+					s.doClose(fmt.Errorf("keepalive timeout: no pong within %v", timeout))
+				}
+			})
+		}
+	}
+}
+
+// handlePing replies to a ping frame read inline by readLoop; pings never
+// reach the yin/yang dispatch.
+func (s *Session) handlePing(payload []byte) {
+	_ = s.write(encodeHeader(streamTypePong, payload))
+}
+
+func (s *Session) handlePong(payload []byte) {
+	id := decodePingID(payload)
+	for {
+		cur := atomic.LoadUint64(&s.ackedPing)
+		if id <= cur || atomic.CompareAndSwapUint64(&s.ackedPing, cur, id) {
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package bidirpc
+
+import "bytes"
+
+// WithMaxMessageSize rejects any frame whose declared body length exceeds n
+// before allocating a buffer for it, closing the session instead. Without
+// it, a peer declaring an enormous bodyLen can force an
+// equally enormous allocation before a single byte of the body is read.
+func WithMaxMessageSize(n int) Option {
+	return func(o *sessionOptions) { o.maxMessageSize = n }
+}
+
+// WithMaxInflight bounds how many decoded-but-not-yet-consumed messages may
+// queue up for a single yin/yang stream: n in a relay queue, in front of the
+// stream's own buffer of defaultStreamInflight messages, plus the one the
+// relay is handing over. Once that is full, readLoop blocks delivering further frames for that stream until the
+// handler catches up, applying back-pressure to the peer instead of
+// growing memory without bound.
+func WithMaxInflight(n int) Option {
+	return func(o *sessionOptions) { o.maxInflight = n }
+}
+
+// inflightQueue is a bounded relay sitting in front of a *stream's inC: it
+// gives readLoop a fixed-size mailbox to push into (back-pressuring the
+// peer once full) independent of however inC itself is sized.
+type inflightQueue struct {
+	queue chan *bytes.Buffer
+}
+
+func newInflightQueue(capacity int) *inflightQueue {
+	return &inflightQueue{queue: make(chan *bytes.Buffer, capacity)}
+}
+
+// run drains q into inC until the session closes.
+func (q *inflightQueue) run(closedC chan struct{}, inC chan *bytes.Buffer) {
+	for {
+		select {
+		case buf := <-q.queue:
+			select {
+			case inC <- buf:
+			case <-closedC:
+				return
+			}
+		case <-closedC:
+			return
+		}
+	}
+}
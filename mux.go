@@ -0,0 +1,187 @@
+package bidirpc
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// muxHeaderLen is the outer envelope MuxSession wraps around whatever a
+// logical session itself writes: a 4-byte session ID followed by a 4-byte
+// body length. It is entirely separate from (and wraps) Session's own
+// streamType/bodyLen header, so Session and everything built on it (calls,
+// control frames, keepalive) is unaware it's being multiplexed.
+const muxHeaderLen = 8
+
+// MuxSession demultiplexes many logical sessions over a single underlying
+// io.ReadWriteCloser. Open returns a fresh io.ReadWriteCloser to hand to
+// NewSession; MuxSession's own readLoop fans incoming bytes out to the
+// right one by session ID, the same way a Session's readLoop fans out to
+// its yin/yang streams and calls by stream type and call ID.
+type MuxSession struct {
+	conn io.ReadWriteCloser
+
+	writeLock sync.Mutex
+
+	mu     sync.Mutex
+	nextID uint32
+	conns  map[uint32]*muxConn
+	closed bool
+
+	closedC chan struct{}
+}
+
+// NewMuxSession starts demultiplexing conn. The caller must Open at least
+// one logical session to make use of it, and Close it once done: closing
+// the Open'd sessions, even all of them, leaves m and conn open.
+func NewMuxSession(conn io.ReadWriteCloser) *MuxSession {
+	m := &MuxSession{
+		conn:    conn,
+		conns:   make(map[uint32]*muxConn),
+		closedC: make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// Open creates a new logical session multiplexed over m's conn. The
+// returned io.ReadWriteCloser is intended to be passed to NewSession.
+func (m *MuxSession) Open() io.ReadWriteCloser {
+	m.mu.Lock()
+	m.nextID++
+	id := m.nextID
+	c := &muxConn{
+		mux:     m,
+		id:      id,
+		inC:     make(chan []byte, defaultStreamInflight),
+		closedC: make(chan struct{}),
+	}
+	m.conns[id] = c
+	m.mu.Unlock()
+	return c
+}
+
+func (m *MuxSession) readLoop() {
+	defer m.Close()
+
+	header := make([]byte, muxHeaderLen)
+	for {
+		if _, err := io.ReadFull(m.conn, header); err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(header[:4])
+		bodyLen := binary.BigEndian.Uint32(header[4:])
+		body := make([]byte, bodyLen)
+		if _, err := io.ReadFull(m.conn, body); err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		c, ok := m.conns[id]
+		m.mu.Unlock()
+		if !ok {
+			// Session already closed (or an ID we never opened); drop.
+			continue
+		}
+
+		select {
+		case c.inC <- body:
+		case <-c.closedC:
+		case <-m.closedC:
+			return
+		}
+	}
+}
+
+func (m *MuxSession) write(id uint32, p []byte) error {
+	header := make([]byte, muxHeaderLen)
+	binary.BigEndian.PutUint32(header[:4], id)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	if _, err := m.conn.Write(header); err != nil {
+		return err
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	_, err := m.conn.Write(p)
+	return err
+}
+
+func (m *MuxSession) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.conns, id)
+	m.mu.Unlock()
+}
+
+// Close tears down every logical session Open'd over m and closes the
+// underlying conn.
+func (m *MuxSession) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	conns := make([]*muxConn, 0, len(m.conns))
+	for _, c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.mu.Unlock()
+
+	close(m.closedC)
+	for _, c := range conns {
+		c.closeLocal()
+	}
+	return m.conn.Close()
+}
+
+// muxConn is one logical session's view over a MuxSession's shared conn.
+type muxConn struct {
+	mux *MuxSession
+	id  uint32
+
+	inC chan []byte
+	cur []byte
+
+	closedC   chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *muxConn) Write(p []byte) (int, error) {
+	if err := c.mux.write(c.id, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *muxConn) Read(p []byte) (int, error) {
+	for len(c.cur) == 0 {
+		select {
+		case buf, ok := <-c.inC:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.cur = buf
+		case <-c.closedC:
+			return 0, io.ErrClosedPipe
+		}
+	}
+	n := copy(p, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+// Close closes this logical session only; the underlying conn and any
+// other session multiplexed over it are unaffected.
+func (c *muxConn) Close() error {
+	c.mux.remove(c.id)
+	c.closeLocal()
+	return nil
+}
+
+func (c *muxConn) closeLocal() {
+	c.closeOnce.Do(func() { close(c.closedC) })
+}
@@ -0,0 +1,236 @@
+package bidirpc
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DialFunc opens the underlying transport addr's Sessions are multiplexed
+// on top of, e.g. net.Dial wrapped to return the net.Conn as an
+// io.ReadWriteCloser. It's called once per addr, except that concurrent
+// first Gets for the same addr may each dial, in which case only one conn is
+// kept and the others are closed; every Session the pool hands out for that
+// addr shares the kept conn via a MuxSession.
+type DialFunc func(addr string) (io.ReadWriteCloser, error)
+
+const defaultPoolMaxIdle = 8
+
+// PoolOption configures a SessionPool.
+type PoolOption func(*SessionPool)
+
+// WithPoolMaxIdle caps the number of idle sessions kept per address; the
+// least-recently-used idle session is closed and evicted past that.
+func WithPoolMaxIdle(n int) PoolOption {
+	return func(p *SessionPool) { p.maxIdle = n }
+}
+
+// WithPoolIdleTimeout closes and evicts an idle session that has sat unused
+// longer than d. A zero d (the default) disables idle expiry.
+func WithPoolIdleTimeout(d time.Duration) PoolOption {
+	return func(p *SessionPool) { p.idleTimeout = d }
+}
+
+// WithPoolHealthCheck runs check against a Session pulled out of the idle
+// pool before handing it back from Get; a non-nil error discards it and
+// dials a fresh one instead.
+func WithPoolHealthCheck(check func(*Session) error) PoolOption {
+	return func(p *SessionPool) { p.healthCheck = check }
+}
+
+// SessionPool amortizes the cost of setting up a Session across many
+// callers, keyed by addr. Unlike a plain connection-reuse pool, it dials at
+// most one underlying transport conn per addr and multiplexes every
+// Session for that addr over it via MuxSession, so concurrently held
+// Sessions to the same addr still share a single TCP/TLS handshake.
+// Sessions themselves are handed out exclusively: a Session checked out of
+// the pool by Get is not shared until it's returned via Release.
+type SessionPool struct {
+	dial           DialFunc
+	yinOrYang      bool
+	bufferPoolSize int
+	sessionOpts    []Option
+
+	maxIdle     int
+	idleTimeout time.Duration
+	healthCheck func(*Session) error
+
+	mu    sync.Mutex
+	idle  map[string]*list.List // addr -> list of *pooledSession, front = most recently released
+	index map[*Session]*poolEntry
+	mux   map[string]*MuxSession // addr -> shared multiplexed conn
+}
+
+type pooledSession struct {
+	sess     *Session
+	addr     string
+	lastUsed time.Time
+}
+
+type poolEntry struct {
+	addr string
+	elem *list.Element
+}
+
+// NewSessionPool creates a pool that dials new Sessions with dial and the
+// given yinOrYang/bufferPoolSize/Option configuration, as would otherwise
+// be passed to NewSession directly.
+func NewSessionPool(dial DialFunc, yinOrYang bool, bufferPoolSize int, sessionOpts []Option, poolOpts ...PoolOption) *SessionPool {
+	p := &SessionPool{
+		dial:           dial,
+		yinOrYang:      yinOrYang,
+		bufferPoolSize: bufferPoolSize,
+		sessionOpts:    sessionOpts,
+		maxIdle:        defaultPoolMaxIdle,
+		idle:           make(map[string]*list.List),
+		index:          make(map[*Session]*poolEntry),
+		mux:            make(map[string]*MuxSession),
+	}
+	for _, opt := range poolOpts {
+		opt(p)
+	}
+	return p
+}
+
+// Get returns a Session for addr, reusing an idle one when available and
+// healthy, or dialing a new one otherwise. The caller owns the Session
+// exclusively until it calls Release.
+func (p *SessionPool) Get(addr string) (*Session, error) {
+	for {
+		ps, ok := p.popIdle(addr)
+		if !ok {
+			return p.dialNew(addr)
+		}
+		if p.idleTimeout > 0 && time.Since(ps.lastUsed) > p.idleTimeout {
+			ps.sess.Close()
+			continue
+		}
+		if p.healthCheck != nil {
+			if err := p.healthCheck(ps.sess); err != nil {
+				ps.sess.Close()
+				continue
+			}
+		}
+		p.mu.Lock()
+		p.index[ps.sess] = &poolEntry{addr: addr}
+		p.mu.Unlock()
+		return ps.sess, nil
+	}
+}
+
+func (p *SessionPool) dialNew(addr string) (*Session, error) {
+	mux, err := p.muxFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := NewSession(mux.Open(), p.yinOrYang, p.bufferPoolSize, p.sessionOpts...)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.index[sess] = &poolEntry{addr: addr}
+	p.mu.Unlock()
+	return sess, nil
+}
+
+// muxFor returns the shared MuxSession for addr, dialing and wrapping a new
+// transport conn the first time addr is seen.
+func (p *SessionPool) muxFor(addr string) (*MuxSession, error) {
+	p.mu.Lock()
+	if mux, ok := p.mux[addr]; ok {
+		p.mu.Unlock()
+		return mux, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bidirpc: dial %s: %w", addr, err)
+	}
+	mux := NewMuxSession(conn)
+
+	p.mu.Lock()
+	if existing, ok := p.mux[addr]; ok {
+		p.mu.Unlock()
+		mux.Close()
+		return existing, nil
+	}
+	p.mux[addr] = mux
+	p.mu.Unlock()
+	return mux, nil
+}
+
+// Release returns sess to the pool for reuse. If err is non-nil, or the
+// session has been closed, it's discarded instead of pooled.
+func (p *SessionPool) Release(sess *Session, err error) {
+	p.mu.Lock()
+	entry, ok := p.index[sess]
+	if ok {
+		delete(p.index, sess)
+	}
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err != nil || sess.isClosed() {
+		sess.Close()
+		return
+	}
+	p.pushIdle(entry.addr, sess)
+}
+
+func (p *SessionPool) popIdle(addr string) (*pooledSession, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.idle[addr]
+	if l == nil || l.Len() == 0 {
+		return nil, false
+	}
+	elem := l.Front()
+	l.Remove(elem)
+	return elem.Value.(*pooledSession), true
+}
+
+func (p *SessionPool) pushIdle(addr string, sess *Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.idle[addr]
+	if l == nil {
+		l = list.New()
+		p.idle[addr] = l
+	}
+	l.PushFront(&pooledSession{sess: sess, addr: addr, lastUsed: time.Now()})
+
+	for l.Len() > p.maxIdle {
+		oldest := l.Back()
+		l.Remove(oldest)
+		oldest.Value.(*pooledSession).sess.Close()
+	}
+}
+
+// Close closes every idle Session held by the pool and every shared
+// MuxSession (and so transport conn) it dialed. Sessions currently checked
+// out via Get are not closed directly, but the conn they run over is, so
+// they close once their read loop sees it; Release then discards them.
+func (p *SessionPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, l := range p.idle {
+		for e := l.Front(); e != nil; e = e.Next() {
+			e.Value.(*pooledSession).sess.Close()
+		}
+	}
+	p.idle = make(map[string]*list.List)
+
+	for _, mux := range p.mux {
+		mux.Close()
+	}
+	p.mux = make(map[string]*MuxSession)
+	return nil
+}
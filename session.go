@@ -2,6 +2,7 @@ package bidirpc
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/rpc"
@@ -9,12 +10,19 @@ import (
 )
 
 var (
-	streamTypeYin  byte = 1
-	streamTypeYang byte = 2
+	streamTypeYin     byte = 1
+	streamTypeYang    byte = 2
+	streamTypeCall    byte = 3
+	streamTypeControl byte = 4
+	streamTypePing    byte = 5
+	streamTypePong    byte = 6
 )
 
 const (
-	defaultBufferPoolSize = 16
+	// defaultBufferPoolSize caps how large a *bytes.Buffer readLoop will
+	// hand back to bp for reuse; anything bigger is left for GC instead of
+	// bloating the pool.
+	defaultBufferPoolSize = 64 << 10
 )
 
 // Session is a bi-direction RPC connection.
@@ -27,19 +35,52 @@ type Session struct {
 	streamYin  *stream
 	streamYang *stream
 
-	client *rpc.Client
-	server *rpc.Server
+	client     *rpc.Client
+	dispatcher *dispatcher
+
+	clientMu         sync.RWMutex
+	clientMiddleware []ClientMiddleware
+
+	streamMu       sync.RWMutex
+	streamHandlers map[string]StreamHandler
+	calls          map[uint64]*callRoute
+	nextCallID     uint64
+
+	ctxMu      sync.Mutex
+	pendingCtx *pendingCtxSlot
+
+	ctxStateMu sync.Mutex
+	ctxCalls   map[uint64]*ctxCall
+	ctxPending map[uint64][]controlFrame
+
+	maxMessageSize int
+	yinInflight    *inflightQueue
+	yangInflight   *inflightQueue
+
+	sentPing  uint64
+	ackedPing uint64
 
 	closeLock sync.Mutex
 	closed    bool
 	closedC   chan struct{}
 }
 
-// NewSession creates a new session.
-func NewSession(conn io.ReadWriteCloser, yinOrYang bool, bufferPoolSize int) (*Session, error) {
+// NewSession creates a new session. By default both sides speak bidirpc's
+// built-in gob encoding; pass WithClientCodec/WithServerCodec to negotiate
+// something else (see the codec/jsonrpc, codec/protorpc and codec/msgpack
+// subpackages). bufferPoolSize is the largest buffer capacity (in bytes)
+// the session will retain in its internal pool for reuse; pass 0 for the
+// default. Buffers grown past it by an oversized message are returned to
+// GC instead of kept around.
+func NewSession(conn io.ReadWriteCloser, yinOrYang bool, bufferPoolSize int, opts ...Option) (*Session, error) {
 	if bufferPoolSize == 0 {
 		bufferPoolSize = defaultBufferPoolSize
 	}
+	o := &sessionOptions{clientCodec: gobCodec{}, serverCodec: gobCodec{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	s := &Session{
 		conn:      conn,
 		yinOrYang: yinOrYang,
@@ -50,20 +91,50 @@ func NewSession(conn io.ReadWriteCloser, yinOrYang bool, bufferPoolSize int) (*S
 	s.streamYin = newStream(s, streamTypeYin)
 	s.streamYang = newStream(s, streamTypeYang)
 
-	var cliCodec *clientCodec
-	var svrCodec *serverCodec
+	s.maxMessageSize = o.maxMessageSize
+	if o.maxInflight > 0 {
+		s.yinInflight = newInflightQueue(o.maxInflight)
+		s.yangInflight = newInflightQueue(o.maxInflight)
+		go s.yinInflight.run(s.closedC, s.streamYin.inC)
+		go s.yangInflight.run(s.closedC, s.streamYang.inC)
+	}
+
+	var cliStream, svrStream *stream
 	if yinOrYang {
-		cliCodec = newClientCodec(s.streamYin)
-		svrCodec = newServerCodec(s.streamYang)
+		cliStream, svrStream = s.streamYin, s.streamYang
 	} else {
-		cliCodec = newClientCodec(s.streamYang)
-		svrCodec = newServerCodec(s.streamYin)
+		cliStream, svrStream = s.streamYang, s.streamYin
 	}
-	s.client = rpc.NewClientWithCodec(cliCodec)
-	s.server = rpc.NewServer()
 
-	go s.server.ServeCodec(svrCodec)
+	var cliCodec rpc.ClientCodec
+	var svrCodec rpc.ServerCodec
+	if _, ok := o.clientCodec.(gobCodec); ok {
+		cliCodec = newClientCodec(cliStream)
+	} else {
+		gc, err := newGenericClientCodec(cliStream, o.clientCodec)
+		if err != nil {
+			return nil, err
+		}
+		cliCodec = gc
+	}
+	if _, ok := o.serverCodec.(gobCodec); ok {
+		svrCodec = newServerCodec(svrStream)
+	} else {
+		gc, err := newGenericServerCodec(svrStream, o.serverCodec)
+		if err != nil {
+			return nil, err
+		}
+		svrCodec = gc
+	}
+
+	s.client = rpc.NewClientWithCodec(&ctxClientCodec{ClientCodec: cliCodec, sess: s})
+	s.dispatcher = newDispatcher()
+
+	go s.serveCodec(svrCodec)
 	go s.readLoop()
+	if o.keepaliveInterval > 0 {
+		go s.keepaliveLoop(o.keepaliveInterval, o.keepaliveTimeout)
+	}
 
 	return s, nil
 }
@@ -79,13 +150,13 @@ func NewSession(conn io.ReadWriteCloser, yinOrYang bool, bufferPoolSize int) (*S
 // The client accesses each method using a string of the form "Type.Method",
 // where Type is the receiver's concrete type.
 func (s *Session) Register(rcvr interface{}) error {
-	return s.server.Register(rcvr)
+	return s.dispatcher.register("", rcvr)
 }
 
 // RegisterName is like Register but uses the provided name for the type
 // instead of the receiver's concrete type.
 func (s *Session) RegisterName(name string, rcvr interface{}) error {
-	return s.server.RegisterName(name, rcvr)
+	return s.dispatcher.register(name, rcvr)
 }
 
 // Go invokes the function asynchronously. It returns the Call structure representing
@@ -93,12 +164,28 @@ func (s *Session) RegisterName(name string, rcvr interface{}) error {
 // the same Call object. If done is nil, Go will allocate a new channel.
 // If non-nil, done must be buffered or Go will deliberately crash.
 func (s *Session) Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
-	return s.client.Go(serviceMethod, args, reply, done)
+	return s.GoContext(context.Background(), serviceMethod, args, reply, done)
 }
 
 // Call invokes the named function, waits for it to complete, and returns its error status.
 func (s *Session) Call(serviceMethod string, args interface{}, reply interface{}) error {
-	return s.client.Call(serviceMethod, args, reply)
+	return s.callWithMiddleware(context.Background(), serviceMethod, args, reply)
+}
+
+// callWithMiddleware runs serviceMethod through the client middleware chain
+// installed via UseClient, the same chain Call, CallContext and GoContext
+// all build around a base doCall invocation.
+func (s *Session) callWithMiddleware(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	s.clientMu.RLock()
+	chain := append([]ClientMiddleware(nil), s.clientMiddleware...)
+	s.clientMu.RUnlock()
+
+	call := func() error { return s.doCall(ctx, serviceMethod, args, reply) }
+	for i := len(chain) - 1; i >= 0; i-- {
+		mw, next := chain[i], call
+		call = func() error { return mw(serviceMethod, args, reply, next) }
+	}
+	return call()
 }
 
 // Close closes the session.
@@ -107,6 +194,14 @@ func (s *Session) Close() error {
 	return nil
 }
 
+// isClosed reports whether the session has already been torn down, e.g. so
+// a SessionPool knows not to return it to its idle set.
+func (s *Session) isClosed() bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.closed
+}
+
 func (s *Session) readLoop() {
 	var err error
 	var header [4]byte
@@ -123,10 +218,20 @@ loop:
 		}
 
 		streamType, bodyLen = decodeHeader(header[:])
-		if (streamType != streamTypeYin && streamType != streamTypeYang) || (bodyLen <= 0) {
+		switch streamType {
+		case streamTypeYin, streamTypeYang, streamTypeCall, streamTypeControl, streamTypePing, streamTypePong:
+		default:
 			s.doClose(fmt.Errorf("read a invalid header"))
 			break loop
 		}
+		if bodyLen <= 0 {
+			s.doClose(fmt.Errorf("read a invalid header"))
+			break loop
+		}
+		if s.maxMessageSize > 0 && bodyLen > s.maxMessageSize {
+			s.doClose(fmt.Errorf("read a frame of %d bytes, exceeding max message size %d", bodyLen, s.maxMessageSize))
+			break loop
+		}
 
 		body := s.bp.Get()
 		body.Grow(bodyLen)
@@ -138,12 +243,48 @@ loop:
 			break loop
 		}
 
+		if streamType == streamTypeCall {
+			s.dispatchCallFrame(body.Bytes())
+			s.bp.Put(body)
+			continue loop
+		}
+
+		if streamType == streamTypeControl {
+			s.dispatchControlFrame(body.Bytes())
+			s.bp.Put(body)
+			continue loop
+		}
+
+		if streamType == streamTypePing {
+			s.handlePing(body.Bytes())
+			s.bp.Put(body)
+			continue loop
+		}
+
+		if streamType == streamTypePong {
+			s.handlePong(body.Bytes())
+			s.bp.Put(body)
+			continue loop
+		}
+
 		var inC *chan *bytes.Buffer
+		var inflight *inflightQueue
 		switch streamType {
 		case streamTypeYin:
-			inC = &s.streamYin.inC
+			inC, inflight = &s.streamYin.inC, s.yinInflight
 		case streamTypeYang:
-			inC = &s.streamYang.inC
+			inC, inflight = &s.streamYang.inC, s.yangInflight
+		}
+
+		if inflight != nil {
+			select {
+			case <-s.closedC:
+				break loop
+			case inflight.queue <- body:
+				// do nothing; inflight.run forwards it into inC, applying
+				// back-pressure to this very read loop once the relay fills up
+			}
+			continue loop
 		}
 		select {
 		case <-s.closedC:
@@ -178,4 +319,7 @@ func (s *Session) doClose(err error) {
 	close(s.closedC)
 	s.conn.Close()
 	s.client.Close()
+
+	s.cancelAllCalls()
+	s.cancelAllCtxCalls()
 }
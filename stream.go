@@ -0,0 +1,55 @@
+package bidirpc
+
+import (
+	"bytes"
+	"io"
+)
+
+// stream is one direction of the yin/yang pair multiplexed over a Session's
+// conn: Write frames outgoing bytes with streamType and sends them through
+// the Session, Read serves back the bodies readLoop delivered on inC, one
+// frame at a time, as a plain byte stream.
+type stream struct {
+	sess       *Session
+	streamType byte
+	inC        chan *bytes.Buffer
+
+	cur *bytes.Buffer
+}
+
+const defaultStreamInflight = 64
+
+func newStream(sess *Session, streamType byte) *stream {
+	return &stream{
+		sess:       sess,
+		streamType: streamType,
+		inC:        make(chan *bytes.Buffer, defaultStreamInflight),
+	}
+}
+
+func (st *stream) Write(p []byte) (int, error) {
+	if err := st.sess.write(encodeHeader(st.streamType, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (st *stream) Read(p []byte) (int, error) {
+	if st.cur == nil || st.cur.Len() == 0 {
+		select {
+		case buf, ok := <-st.inC:
+			if !ok {
+				return 0, io.EOF
+			}
+			st.cur = buf
+		case <-st.sess.closedC:
+			return 0, io.ErrClosedPipe
+		}
+	}
+	n, err := st.cur.Read(p)
+	if st.cur.Len() == 0 {
+		st.sess.bp.Put(st.cur)
+		st.cur = nil
+	}
+	return n, err
+}